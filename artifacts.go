@@ -0,0 +1,21 @@
+package main
+
+// MaybeStageArtifacts stages --artifacts-in's per-item tarball into the
+// pod's artifact volume before it's applied, if the flag was given. The
+// local path is expanded with the same TemplateVars as the pod YAML.
+func MaybeStageArtifacts(ex Executor, podname string, vars TemplateVars) {
+	if opts.ArtifactsIn == "" {
+		return
+	}
+	localPath := ExpandVars(opts.ArtifactsIn, vars)
+	Handle(ex.StageArtifacts(podname, localPath, vars.ArtifactMount))
+}
+
+// MaybeExportArtifacts exports --artifact-path out of a Succeeded pod
+// into --artifacts-out, if the flag was given.
+func MaybeExportArtifacts(ex Executor, podname string) {
+	if opts.ArtifactsOut == "" {
+		return
+	}
+	Handle(ex.ExportArtifacts(podname, opts.ArtifactPath, opts.ArtifactsOut))
+}
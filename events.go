@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event is one line of the --events newline-delimited JSON stream: a
+// machine-readable mirror of what the human infolog lines report, for
+// piping qupods into jq, a TUI, or a metrics collector.
+type Event struct {
+	Time     string  `json:"time"`
+	Type     string  `json:"type"`
+	Pod      string  `json:"pod,omitempty"`
+	Index    *int    `json:"index,omitempty"`
+	Item     string  `json:"item,omitempty"`
+	Prev     string  `json:"prev,omitempty"`
+	Next     string  `json:"next,omitempty"`
+	Log      string  `json:"log,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Attempt  int     `json:"attempt,omitempty"`
+}
+
+// IndexOf makes an *int for Event.Index. A plain int field with
+// `omitempty` would drop item index 0, making it indistinguishable from
+// an event that carries no index at all.
+func IndexOf(index int) *int {
+	return &index
+}
+
+var eventMutex sync.Mutex
+var eventEncoder *json.Encoder
+
+// OpenEvents wires up --events. "-" writes to stdout; anything else is a
+// path to create. Left unset (the default), EmitEvent is a no-op.
+func OpenEvents(spec string) {
+	if spec == "" {
+		return
+	}
+	out := os.Stdout
+	if spec != "-" {
+		var err error
+		out, err = os.Create(spec)
+		Handle(err)
+	}
+	eventEncoder = json.NewEncoder(out)
+}
+
+// EmitEvent appends one event to the --events stream, stamping it with
+// the current time. A no-op when --events wasn't given.
+func EmitEvent(ev Event) {
+	if eventEncoder == nil {
+		return
+	}
+	ev.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	eventEncoder.Encode(ev)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// artifactPVCTemplate and artifactStagerTemplate back KubectlExecutor's
+// StageArtifacts: a PVC to hold the staged tarball, and a short-lived pod
+// that mounts it so `kubectl cp`/`exec` can populate it before the real
+// pod (which mounts the same PVC via {{.ArtifactClaim}} at
+// {{.ArtifactMount}}) is applied.
+const artifactPVCTemplate = `apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: %s
+spec:
+  accessModes: ["ReadWriteOnce"]
+  resources:
+    requests:
+      storage: 1Gi
+`
+
+// artifactStageTimeout bounds how long StageArtifacts waits for the
+// staging pod to reach Running before giving up, so a PVC that never
+// binds (or a stager that never gets scheduled) doesn't hang qupods
+// forever.
+const artifactStageTimeout = 120.0
+
+const artifactStagerTemplate = `apiVersion: v1
+kind: Pod
+metadata:
+  name: %s
+spec:
+  restartPolicy: Never
+  containers:
+  - name: stage
+    image: busybox
+    command: ["sleep", "3600"]
+    volumeMounts:
+    - name: artifacts
+      mountPath: %s
+  volumes:
+  - name: artifacts
+    persistentVolumeClaim:
+      claimName: %s
+`
+
+// RunCmd runs the given shell command (split on spaces, as opts.Kubectl
+// and opts.Podman are) with args appended, optionally feeding input on
+// stdin, and returns stdout. Stderr is forwarded to errlog.
+func RunCmd(input string, command string, args ...string) ([]byte, error) {
+	argv := strings.Split(command, " ")
+	argv = append(argv, args...)
+	debuglog.Println(strings.Join(argv, "|"))
+	proc := exec.Command(argv[0], argv[1:]...)
+	if input != "" {
+		stdin, err := proc.StdinPipe()
+		Handle(err)
+		go func() {
+			defer stdin.Close()
+			io.WriteString(stdin, input)
+		}()
+	}
+	stderr, err := proc.StderrPipe()
+	Handle(err)
+	go func() {
+		output, _ := ioutil.ReadAll(stderr)
+		if string(output) != "" {
+			errlog.Print(string(output))
+		}
+	}()
+	out, err := proc.Output()
+	return out, err
+}
+
+// Executor abstracts the backend used to run and observe pods, so that
+// qupods can target either a real Kubernetes cluster or a local podman
+// install with the same item/YAML/template workflow.
+type Executor interface {
+	// Apply submits the rendered pod YAML.
+	Apply(yaml string) error
+	// Logs returns the captured log output for a terminated pod.
+	Logs(podname string) ([]byte, error)
+	// Delete removes a terminated pod.
+	Delete(podname string) error
+	// List returns the phase of every known pod, keyed by name.
+	List() (map[string]string, error)
+	// Watch streams pod phase observations as they occur. Backends that
+	// can't support a live stream return an error and callers fall back
+	// to polling List().
+	Watch() (<-chan PodEvent, error)
+	// StageArtifacts makes the tarball at localPath available to podname
+	// at mountPath before the pod is applied, via a PVC/volume named
+	// "<podname>-artifacts" (also exposed to pod YAML templates as
+	// TemplateVars.ArtifactClaim, so the real pod can mount it).
+	StageArtifacts(podname, localPath, mountPath string) error
+	// ExportArtifacts copies remotePath out of a Succeeded podname into
+	// localDir/<podname>.tar, before the pod is deleted.
+	ExportArtifacts(podname, remotePath, localDir string) error
+}
+
+// NewExecutor builds the Executor selected by --backend.
+func NewExecutor(backend string) Executor {
+	switch backend {
+	case "kubectl":
+		return &KubectlExecutor{}
+	case "podman":
+		return &PodmanExecutor{}
+	}
+	Validate(false, "unknown backend:", backend)
+	return nil
+}
+
+// KubectlExecutor drives opts.Kubectl (kubectl or microk8s kubectl),
+// the original and default backend.
+type KubectlExecutor struct{}
+
+func (ex *KubectlExecutor) Apply(yaml string) error {
+	_, err := RunCmd(yaml, opts.Kubectl, "apply", "-f", "-")
+	return err
+}
+
+func (ex *KubectlExecutor) Logs(podname string) ([]byte, error) {
+	return RunCmd("", opts.Kubectl, "logs", "pod/"+podname)
+}
+
+func (ex *KubectlExecutor) Delete(podname string) error {
+	_, err := RunCmd("", opts.Kubectl, "delete", "pod/"+podname)
+	return err
+}
+
+func (ex *KubectlExecutor) List() (map[string]string, error) {
+	status := PodStatus{}
+	data, err := RunCmd("", opts.Kubectl, "get", "pods", "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(data, &status)
+	result := map[string]string{}
+	for _, item := range status.Items {
+		result[item.Metadata.Name] = item.Status.Phase
+	}
+	return result, nil
+}
+
+// Watch runs `kubectl get pods --watch -o json` as a long-lived subprocess
+// and decodes the stream of one-pod-per-event JSON objects it emits.
+func (ex *KubectlExecutor) Watch() (<-chan PodEvent, error) {
+	argv := strings.Split(opts.Kubectl, " ")
+	argv = append(argv, "get", "pods", "--watch", "-o", "json")
+	debuglog.Println(strings.Join(argv, "|"))
+	proc := exec.Command(argv[0], argv[1:]...)
+	stdout, err := proc.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := proc.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := proc.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		output, _ := ioutil.ReadAll(stderr)
+		if len(output) != 0 {
+			errlog.Print(string(output))
+		}
+	}()
+	events := make(chan PodEvent)
+	go func() {
+		defer close(events)
+		decoder := json.NewDecoder(stdout)
+		for decoder.More() {
+			var pod Pod
+			if err := decoder.Decode(&pod); err != nil {
+				debuglog.Println("watch decode error:", err)
+				break
+			}
+			events <- PodEvent{
+				Name:            pod.Metadata.Name,
+				Phase:           pod.Status.Phase,
+				ResourceVersion: pod.Metadata.ResourceVersion,
+			}
+		}
+		proc.Wait()
+	}()
+	return events, nil
+}
+
+// PodmanExecutor drives opts.Podman for single-machine execution: each
+// rendered pod YAML is handed to `podman kube play -`, and status/logs
+// come from `podman pod ps`/`podman logs` instead of the Kubernetes API.
+type PodmanExecutor struct{}
+
+func (ex *PodmanExecutor) Apply(yaml string) error {
+	_, err := RunCmd(yaml, opts.Podman, "kube", "play", "-")
+	return err
+}
+
+func (ex *PodmanExecutor) Logs(podname string) ([]byte, error) {
+	container, err := podmanWorkloadContainer(podname)
+	if err != nil {
+		return nil, err
+	}
+	if len(container.Names) == 0 {
+		return nil, fmt.Errorf("container for pod %s has no name", podname)
+	}
+	return RunCmd("", opts.Podman, "logs", container.Names[0])
+}
+
+func (ex *PodmanExecutor) Delete(podname string) error {
+	_, err := RunCmd("", opts.Podman, "pod", "rm", "-f", podname)
+	return err
+}
+
+type podmanPod struct {
+	Name   string
+	Status string
+}
+
+// podmanContainer is one entry of `podman ps --format json`. IsInfra marks
+// the hidden per-pod infra container that `podman kube play` adds, which
+// isn't the workload container qupods cares about.
+type podmanContainer struct {
+	Names    []string
+	IsInfra  bool
+	ExitCode int
+}
+
+// podmanWorkloadContainer finds podname's single workload container.
+// `podman kube play` names it "<pod>-<container>" rather than just the pod
+// name, and also creates a hidden infra container per pod, so neither the
+// pod name nor "first container" can be assumed.
+func podmanWorkloadContainer(podname string) (podmanContainer, error) {
+	data, err := RunCmd("", opts.Podman, "ps", "-a", "--filter", "pod="+podname, "--format", "json")
+	if err != nil {
+		return podmanContainer{}, err
+	}
+	var containers []podmanContainer
+	json.Unmarshal(data, &containers)
+	for _, c := range containers {
+		if !c.IsInfra {
+			return c, nil
+		}
+	}
+	return podmanContainer{}, fmt.Errorf("no workload container found for pod %s", podname)
+}
+
+func (ex *PodmanExecutor) List() (map[string]string, error) {
+	data, err := RunCmd("", opts.Podman, "pod", "ps", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var pods []podmanPod
+	json.Unmarshal(data, &pods)
+	result := map[string]string{}
+	for _, p := range pods {
+		exitCode := 0
+		if strings.Contains(strings.ToLower(p.Status), "exited") {
+			if container, err := podmanWorkloadContainer(p.Name); err == nil {
+				exitCode = container.ExitCode
+			}
+		}
+		result[p.Name] = PodmanPhase(p.Status, exitCode)
+	}
+	return result, nil
+}
+
+// Watch is unsupported: podman has no equivalent of `kubectl --watch`, so
+// callers fall back to polling List() on this backend.
+func (ex *PodmanExecutor) Watch() (<-chan PodEvent, error) {
+	return nil, errors.New("watch not supported by podman backend")
+}
+
+// StageArtifacts creates (or reuses) a PVC named "<podname>-artifacts" for
+// podname, stages the local tarball into it via a short-lived pod that
+// mounts the same volume, and extracts it there so the real pod, which
+// mounts the PVC via {{.ArtifactClaim}} at {{.ArtifactMount}}, sees the
+// files once it starts.
+func (ex *KubectlExecutor) StageArtifacts(podname, localPath, mountPath string) error {
+	pvcName := podname + "-artifacts"
+	if err := ex.Apply(fmt.Sprintf(artifactPVCTemplate, pvcName)); err != nil {
+		return err
+	}
+	stagerName := podname + "-stage"
+	if err := ex.Apply(fmt.Sprintf(artifactStagerTemplate, stagerName, mountPath, pvcName)); err != nil {
+		return err
+	}
+	waited := float32(0)
+	for {
+		phases, err := ex.List()
+		if err != nil {
+			return err
+		}
+		if phases[stagerName] == "Running" {
+			break
+		}
+		if waited >= artifactStageTimeout {
+			return fmt.Errorf("artifact stager %s didn't reach Running within %.0fs", stagerName, artifactStageTimeout)
+		}
+		Sleep(opts.Poll)
+		waited += opts.Poll
+	}
+	remoteTar := path.Join(mountPath, path.Base(localPath))
+	if _, err := RunCmd("", opts.Kubectl, "cp", localPath, "pod/"+stagerName+":"+remoteTar); err != nil {
+		return err
+	}
+	if _, err := RunCmd("", opts.Kubectl, "exec", "pod/"+stagerName, "--", "tar", "xf", remoteTar, "-C", mountPath); err != nil {
+		return err
+	}
+	// The stager reached Running (never Succeeded/Failed), so the watch
+	// stream counted it into status_counter["Running"] and has no terminal
+	// event coming to release it; evict it ourselves before it's deleted,
+	// or CountActive() never reaches 0 and --maxrunning/--maxpending
+	// throttle on a pod that's already gone.
+	EvictPod(stagerName)
+	return ex.Delete(stagerName)
+}
+
+// ExportArtifacts copies remotePath out of a Succeeded pod into
+// localDir/<podname>.tar before it's deleted.
+func (ex *KubectlExecutor) ExportArtifacts(podname, remotePath, localDir string) error {
+	localTar := path.Join(localDir, podname+".tar")
+	_, err := RunCmd("", opts.Kubectl, "cp", "pod/"+podname+":"+remotePath, localTar)
+	return err
+}
+
+// StageArtifacts imports the local tarball into a podman volume named
+// "<podname>-artifacts" (also exposed as {{.ArtifactClaim}}), mirroring
+// `podman volume import`. mountPath is unused: the real pod's kube YAML
+// is responsible for mounting the same volume.
+func (ex *PodmanExecutor) StageArtifacts(podname, localPath, mountPath string) error {
+	volName := podname + "-artifacts"
+	RunCmd("", opts.Podman, "volume", "create", volName)
+	_, err := RunCmd("", opts.Podman, "volume", "import", volName, localPath)
+	return err
+}
+
+// ExportArtifacts exports the pod's named podman volume, mirroring
+// `podman volume export`. remotePath is unused: the whole volume is
+// exported as a single tarball.
+func (ex *PodmanExecutor) ExportArtifacts(podname, remotePath, localDir string) error {
+	volName := podname + "-artifacts"
+	localTar := path.Join(localDir, podname+".tar")
+	_, err := RunCmd("", opts.Podman, "volume", "export", volName, "--output", localTar)
+	return err
+}
+
+// PodmanPhase maps a `podman pod ps` status (plus the workload container's
+// exit code, for "exited") onto the Kubernetes-style phases the rest of
+// qupods polls on, so both backends drive the same status_counter/
+// pod_status bookkeeping.
+func PodmanPhase(status string, exitCode int) string {
+	status = strings.ToLower(status)
+	switch {
+	case strings.Contains(status, "running"):
+		return "Running"
+	case strings.Contains(status, "created"):
+		return "Pending"
+	case strings.Contains(status, "exited"):
+		if exitCode != 0 {
+			return "Failed"
+		}
+		return "Succeeded"
+	case strings.Contains(status, "error"), strings.Contains(status, "degraded"):
+		return "Failed"
+	case strings.Contains(status, "stopping"):
+		return "Terminating"
+	}
+	return "None"
+}
@@ -6,11 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -24,19 +22,30 @@ import (
 )
 
 var opts struct {
-	Verbose    bool    `short:"v" description:"verbose output"`
-	PrintSpecs bool    `short:"P" description:"print specs before kubectl apply"`
-	Kubectl    string  `long:"kubectl" default:"microk8s kubectl" description:"kubectl command"`
-	Logdir     string  `long:"logdir" default:"./QUPODS" description:"log directory"`
-	NoWait     bool    `long:"nowait" description:"after submitting all jobs, don't wait for completion"`
-	Poll       float32 `long:"poll" default:"3.0" description:"polling frequency in seconds"`
-	Pace       float32 `long:"pace" default:"1.0" description:"submission pace in seconds"`
-	MaxRunning int     `long:"maxrunning" default:"100000" description:"max running jobs"`
-	MaxPending int     `long:"maxpending" default:"3" description:"max pending jobs"`
-	ItemFile   string  `short:"i" long:"items" description:"items as text lines in file"`
-	JsonFile   string  `short:"j" long:"json" description:"items as dict list in JSON"`
-	Braces     string  `short:"b" long:"braces" description:"items using brace expansion"`
-	Positional struct {
+	Verbose       bool    `short:"v" description:"verbose output"`
+	PrintSpecs    bool    `short:"P" description:"print specs before kubectl apply"`
+	Kubectl       string  `long:"kubectl" default:"microk8s kubectl" description:"kubectl command"`
+	Podman        string  `long:"podman" default:"podman" description:"podman command"`
+	Backend       string  `long:"backend" default:"kubectl" description:"execution backend: kubectl or podman"`
+	Logdir        string  `long:"logdir" default:"./QUPODS" description:"log directory"`
+	NoWait        bool    `long:"nowait" description:"after submitting all jobs, don't wait for completion"`
+	Watch         bool    `long:"watch" default:"true" description:"watch for pod status changes instead of polling (kubectl backend only)"`
+	Poll          float32 `long:"poll" default:"3.0" description:"polling frequency in seconds (also the watch reconnect backoff)"`
+	Pace          float32 `long:"pace" default:"1.0" description:"submission pace in seconds"`
+	MaxRunning    int     `long:"maxrunning" default:"100000" description:"max running jobs"`
+	MaxPending    int     `long:"maxpending" default:"3" description:"max pending jobs"`
+	Retries       int     `long:"retries" default:"0" description:"resubmit a Failed item up to this many times"`
+	RetryBackoff  float32 `long:"retry-backoff" default:"1.0" description:"base retry backoff in seconds, doubled per attempt and capped"`
+	RetryOn       string  `long:"retry-on" description:"only retry if the pod's .err log matches this regexp"`
+	Events        string  `long:"events" description:"write newline-delimited JSON events here, - for stdout"`
+	ArtifactsIn   string  `long:"artifacts-in" description:"local path pattern (expanded per-item) staged into the pod's artifact volume before it's applied"`
+	ArtifactsOut  string  `long:"artifacts-out" description:"local directory to export a Succeeded pod's artifact path into as <podname>.tar"`
+	ArtifactPath  string  `long:"artifact-path" default:"/artifacts" description:"in-pod path exported by --artifacts-out"`
+	ArtifactMount string  `long:"artifact-mount" default:"/artifacts" description:"mount point exposed to pod YAML templates as {{.ArtifactMount}}"`
+	ItemFile      string  `short:"i" long:"items" description:"items as text lines in file"`
+	JsonFile      string  `short:"j" long:"json" description:"items as dict list in JSON"`
+	Braces        string  `short:"b" long:"braces" description:"items using brace expansion"`
+	Positional    struct {
 		Input string `required:"yes"`
 	} `positional-args:"yes"`
 }
@@ -131,9 +140,11 @@ func GetPodName(data []byte) string {
 }
 
 type TemplateVars struct {
-	Index  int
-	Item   string
-	Values map[string]string
+	Index         int
+	Item          string
+	Values        map[string]string
+	ArtifactMount string
+	ArtifactClaim string
 }
 
 func ExpandVars(s string, vars TemplateVars) string {
@@ -145,32 +156,17 @@ func ExpandVars(s string, vars TemplateVars) string {
 	return string(buffer.Bytes())
 }
 
-func KubeCtl(input string, args ...string) ([]byte, error) {
-	argv := strings.Split(opts.Kubectl, " ")
-	argv = append(argv, args...)
-	debuglog.Println(strings.Join(argv, "|"))
-	proc := exec.Command(argv[0], argv[1:]...)
-	if input != "" {
-		stdin, err := proc.StdinPipe()
-		Handle(err)
-		go func() {
-			defer stdin.Close()
-			io.WriteString(stdin, input)
-		}()
+// ChangeStatus reacts to a pod's observed phase changing. Callers (KuPoll,
+// ApplyEvent) must already hold watchCond.L, since it's invoked while
+// pod_status/status_counter are mid-update.
+func ChangeStatus(ex Executor, podname, ostatus, nstatus string) {
+	var index *int
+	var item string
+	if vars, ok := item_vars[podname]; ok {
+		index = IndexOf(vars.Index)
+		item = vars.Item
 	}
-	stderr, err := proc.StderrPipe()
-	Handle(err)
-	go func() {
-		output, _ := ioutil.ReadAll(stderr)
-		if string(output) != "" {
-			errlog.Print(string(output))
-		}
-	}()
-	out, err := proc.Output()
-	return out, err
-}
-
-func ChangeStatus(podname, ostatus, nstatus string) {
+	EmitEvent(Event{Type: "phase_change", Pod: podname, Index: index, Item: item, Prev: ostatus, Next: nstatus})
 	if nstatus == "Succeeded" || nstatus == "Failed" {
 		if opts.Logdir == "" {
 			return
@@ -181,24 +177,40 @@ func ChangeStatus(podname, ostatus, nstatus string) {
 		} else {
 			logname = path.Join(opts.Logdir, podname+".err")
 		}
-		data, err := KubeCtl("", "logs", "pod/"+podname)
+		if nstatus == "Succeeded" {
+			MaybeExportArtifacts(ex, podname)
+		}
+		data, err := ex.Logs(podname)
 		Handle(err)
 		ioutil.WriteFile(logname, data, 0666)
-		_, err = KubeCtl("", "delete", "pod/"+podname)
+		err = ex.Delete(podname)
 		Handle(err)
+		duration := time.Since(submit_time[podname]).Seconds()
+		eventType := "succeeded"
+		if nstatus == "Failed" {
+			eventType = "failed"
+		}
+		EmitEvent(Event{Type: eventType, Pod: podname, Index: index, Item: item, Log: logname, Duration: duration})
+		if nstatus == "Failed" {
+			MaybeRetry(ex, podname, data, logname)
+		}
 	}
 }
 
-func GetFileStatus() {
+// ScanFileStatus reports the Succeeded/Failed status already recorded in
+// opts.Logdir (from a previous run), keyed by pod name. It doesn't touch
+// pod_status itself so KuPoll can fold the result in under its own lock.
+func ScanFileStatus() map[string]string {
+	result := map[string]string{}
 	if opts.Logdir == "" {
-		return
+		return result
 	}
 	logs, err := filepath.Glob(path.Join(opts.Logdir, "*.log"))
 	Handle(err)
 	for _, f := range logs {
 		f = path.Base(f)
 		f = strings.TrimSuffix(f, path.Ext(f))
-		pod_status[f] = "Succeeded"
+		result[f] = "Succeeded"
 		debuglog.Println("logstatus", f, "Succeeded")
 	}
 	errs, err := filepath.Glob(path.Join(opts.Logdir, "*.err"))
@@ -206,39 +218,50 @@ func GetFileStatus() {
 	for _, f := range errs {
 		f = path.Base(f)
 		f = strings.TrimSuffix(f, path.Ext(f))
-		pod_status[f] = "Failed"
+		// MaybeRetry renames a pod's final .err to <pod>.attempt<N>.err.
+		f = regexp.MustCompile(`\.attempt[0-9]+$`).ReplaceAllString(f, "")
+		result[f] = "Failed"
 		debuglog.Println("logstatus", f, "Failed")
 	}
+	return result
 }
 
-type PodStatus struct {
-	Items []struct {
-		Metadata struct {
-			Name string
-		}
-		Status struct {
-			Phase string
-		}
+type Pod struct {
+	Metadata struct {
+		Name            string
+		ResourceVersion string
+	}
+	Status struct {
+		Phase string
 	}
 }
 
-func KuPoll() {
-	pod_status = map[string]string{}
-	GetFileStatus()
-	status := PodStatus{}
-	data, err := KubeCtl("", "get", "pods", "-o", "json")
+type PodStatus struct {
+	Items []Pod
+}
+
+// KuPoll rebuilds pod_status/status_counter from scratch from ex.List()
+// (plus any Succeeded/Failed markers already on disk). It holds
+// watchCond.L for the whole rebuild, since a watch goroutine may be
+// updating the same maps concurrently; callers must not already hold it.
+func KuPoll(ex Executor) {
+	fileStatus := ScanFileStatus()
+	phases, err := ex.List()
 	Handle(err)
-	json.Unmarshal(data, &status)
+	watchCond.L.Lock()
+	defer watchCond.L.Unlock()
+	pod_status = map[string]string{}
+	for podname, status := range fileStatus {
+		pod_status[podname] = status
+	}
 	for _, k := range AllPhases {
 		status_counter[k] = 0
 	}
-	for _, item := range status.Items {
-		podname := item.Metadata.Name
-		status := item.Status.Phase
+	for podname, status := range phases {
 		ostatus := pod_status[podname]
 		pod_status[podname] = status
 		if ostatus != status {
-			ChangeStatus(podname, ostatus, status)
+			ChangeStatus(ex, podname, ostatus, status)
 		}
 		status_counter[status]++
 	}
@@ -265,19 +288,38 @@ func ReadItemsJson(fname string) []map[string]string {
 	return result
 }
 
+// CountActive counts pods that are still in flight, including retries
+// that have been scheduled but not yet resubmitted. Caller must hold
+// watchCond.L (WaitUntil already does, for cond functions built on this).
 func CountActive() int {
 	active := status_counter["Pending"]
 	active += status_counter["Running"]
 	active += status_counter["Terminating"]
+	active += pendingRetries
 	return active
 }
 
+// GetStatus formats the current counters for a log line. Caller must hold
+// watchCond.L (WaitUntil already does, for cond functions built on this).
 func GetStatus() string {
-	return fmt.Sprintf("Pending %-3d Running %-6d Succeeded %-6d Failed %-6d",
+	retries := 0
+	for _, n := range attempt_counter {
+		retries += n
+	}
+	return fmt.Sprintf("Pending %-3d Running %-6d Succeeded %-6d Failed %-6d Retries %-3d",
 		status_counter["Pending"],
 		status_counter["Running"],
 		status_counter["Succeeded"],
-		status_counter["Failed"])
+		status_counter["Failed"],
+		retries)
+}
+
+// LockedStatus returns GetStatus()'s result, acquiring watchCond.L itself
+// — for call sites outside of a WaitUntil cond function.
+func LockedStatus() string {
+	watchCond.L.Lock()
+	defer watchCond.L.Unlock()
+	return GetStatus()
 }
 
 func main() {
@@ -303,6 +345,7 @@ func main() {
 		Handle(err)
 	}
 	Validate(lstat.IsDir(), "not a directory:", opts.Logdir)
+	OpenEvents(opts.Events)
 	s, err := ioutil.ReadFile(opts.Positional.Input)
 	Handle(err)
 	yamltemplate = string(s)
@@ -323,41 +366,89 @@ func main() {
 	} else {
 		panic(errors.New("must specify either itemfile or jsonfile"))
 	}
+	ex := NewExecutor(opts.Backend)
+	KuPoll(ex)
+	watching := false
+	if opts.Watch {
+		if err := StartWatch(ex); err != nil {
+			infolog.Println("watch unavailable, falling back to polling:", err)
+		} else {
+			watching = true
+		}
+	}
+	waitUntil := func(cond func() bool) {
+		if watching {
+			WaitUntil(cond)
+		} else {
+			for {
+				watchCond.L.Lock()
+				done := cond()
+				watchCond.L.Unlock()
+				if done {
+					break
+				}
+				Sleep(opts.Poll)
+				KuPoll(ex)
+			}
+		}
+	}
 	for index, dict := range items {
-		vars := TemplateVars{index, dict["item"], dict}
+		vars := TemplateVars{Index: index, Item: dict["item"], Values: dict, ArtifactMount: opts.ArtifactMount}
 		yaml := ExpandVars(yamltemplate, vars)
 		podname := GetPodName([]byte(yaml))
-		KuPoll()
+		// The PVC/volume StageArtifacts stages into is named after podname,
+		// which isn't known until the YAML above is rendered once; expand
+		// again now that ArtifactClaim can be filled in, so the pod YAML can
+		// reference {{.ArtifactClaim}} to mount it.
+		vars.ArtifactClaim = podname + "-artifacts"
+		yaml = ExpandVars(yamltemplate, vars)
+		if !watching {
+			KuPoll(ex)
+		}
 		frac := fmt.Sprintf("%6d/%-6d", index, len(items))
-		infolog.Println(frac, GetStatus())
+		infolog.Println(frac, LockedStatus())
+		watchCond.L.Lock()
 		status := pod_status[podname]
+		watchCond.L.Unlock()
 		if status == "Succeeded" || status == "Failed" {
 			continue
 		}
-		for {
+		// underThreshold is also handed to WaitUntil, which calls it with
+		// watchCond.L already held — it must not lock itself.
+		underThreshold := func() bool {
 			pending := status_counter["Pending"]
 			running := status_counter["Running"]
-			if pending <= opts.MaxPending && running+pending <= opts.MaxRunning {
-				break
-			}
-			Sleep(opts.Poll)
-			KuPoll()
+			return pending <= opts.MaxPending && running+pending <= opts.MaxRunning
+		}
+		watchCond.L.Lock()
+		throttled := !underThreshold()
+		watchCond.L.Unlock()
+		if throttled {
+			EmitEvent(Event{Type: "throttled", Pod: podname, Index: IndexOf(index), Item: vars.Item})
+			waitUntil(underThreshold)
 		}
 		if opts.PrintSpecs {
 			infolog.Println(yaml)
 		}
-		KubeCtl(yaml, "apply", "-f", "-")
+		MaybeStageArtifacts(ex, podname, vars)
+		RegisterSubmission(podname, vars)
+		EmitEvent(Event{Type: "submitted", Pod: podname, Index: IndexOf(index), Item: vars.Item})
+		Handle(ex.Apply(yaml))
 		Sleep(opts.Pace)
 	}
 	if !opts.NoWait {
-		for {
-			if CountActive() == 0 {
-				break
+		infolog.Println("waiting", LockedStatus())
+		// This cond function is also handed to WaitUntil, which calls it
+		// with watchCond.L already held — CountActive/GetStatus must not
+		// lock themselves.
+		waitUntil(func() bool {
+			done := CountActive() == 0
+			if !done {
+				infolog.Println("waiting", GetStatus())
 			}
-			Sleep(opts.Poll)
-			KuPoll()
-			infolog.Println("waiting", GetStatus())
-		}
+			return done
+		})
+		EmitEvent(Event{Type: "wait_complete"})
 	}
-	KuPoll()
+	KuPoll(ex)
 }
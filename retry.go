@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxRetryBackoff caps the exponential backoff applied between retries.
+const maxRetryBackoff = 300.0
+
+var attempt_counter = map[string]int{}
+var item_vars = map[string]TemplateVars{}
+var submit_time = map[string]time.Time{}
+
+// pendingRetries counts retries that have been scheduled (counted into
+// attempt_counter) but whose backoff hasn't elapsed yet, so CountActive
+// doesn't report the batch as finished while one is still queued. It's
+// guarded by watchCond.L, like pod_status/status_counter.
+var pendingRetries int
+
+// RegisterSubmission remembers which TemplateVars rendered podname, and
+// when, so a later Failed status can re-render and resubmit the same
+// item, and terminal events can report how long the pod ran. ChangeStatus
+// reads item_vars/submit_time while holding watchCond.L, so writes here
+// must take the same lock.
+func RegisterSubmission(podname string, vars TemplateVars) {
+	watchCond.L.Lock()
+	defer watchCond.L.Unlock()
+	item_vars[podname] = vars
+	submit_time[podname] = time.Now()
+}
+
+// MaybeRetry re-submits a Failed item's pod up to --retries times with
+// exponential backoff (--retry-backoff * 2^attempt, capped), unless
+// --retry-on is set and the captured .err log doesn't match it. Once
+// retries are exhausted (or the log didn't match), logname is renamed to
+// include the attempt count so the failure history is preserved. Caller
+// (ChangeStatus) must already hold watchCond.L.
+func MaybeRetry(ex Executor, podname string, errlogdata []byte, logname string) {
+	if opts.Retries <= 0 {
+		return
+	}
+	attempt := attempt_counter[podname]
+	finalize := func() {
+		finalname := fmt.Sprintf("%s.attempt%d.err", strings.TrimSuffix(logname, ".err"), attempt+1)
+		os.Rename(logname, finalname)
+	}
+	if opts.RetryOn != "" {
+		matched, err := regexp.Match(opts.RetryOn, errlogdata)
+		Handle(err)
+		if !matched {
+			finalize()
+			return
+		}
+	}
+	if attempt >= opts.Retries {
+		finalize()
+		return
+	}
+	vars, ok := item_vars[podname]
+	if !ok {
+		return
+	}
+	attempt_counter[podname] = attempt + 1
+	backoff := opts.RetryBackoff * float32(int(1)<<uint(attempt))
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	pendingRetries++
+	EmitEvent(Event{Type: "retry", Pod: podname, Index: IndexOf(vars.Index), Item: vars.Item, Attempt: attempt_counter[podname]})
+	go func() {
+		Sleep(backoff)
+		yaml := ExpandVars(yamltemplate, vars)
+		debuglog.Println("retrying", podname, "attempt", attempt_counter[podname])
+		RegisterSubmission(podname, vars)
+		err := ex.Apply(yaml)
+		watchCond.L.Lock()
+		pendingRetries--
+		watchCond.L.Unlock()
+		watchCond.Broadcast()
+		Handle(err)
+	}()
+}
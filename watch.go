@@ -0,0 +1,106 @@
+package main
+
+import "sync"
+
+// PodEvent is one phase observation delivered by Executor.Watch, or
+// synthesized from a poll when the backend doesn't support watching.
+type PodEvent struct {
+	Name            string
+	Phase           string
+	ResourceVersion string
+}
+
+var watchCond = sync.NewCond(&sync.Mutex{})
+var lastResourceVersion = map[string]string{}
+
+// ApplyEvent folds one watch observation into pod_status/status_counter,
+// firing ChangeStatus exactly once per terminal transition, and wakes any
+// goroutine blocked in WaitUntil. Duplicate events from a watch reconnect
+// (same resourceVersion, or no phase change) are ignored. Callers must
+// not already hold watchCond.L.
+func ApplyEvent(ex Executor, ev PodEvent) {
+	watchCond.L.Lock()
+	defer watchCond.L.Unlock()
+	if ev.ResourceVersion != "" && ev.ResourceVersion == lastResourceVersion[ev.Name] {
+		return
+	}
+	if ev.ResourceVersion != "" {
+		lastResourceVersion[ev.Name] = ev.ResourceVersion
+	}
+	ostatus := pod_status[ev.Name]
+	if ostatus == ev.Phase {
+		return
+	}
+	if ostatus != "" {
+		status_counter[ostatus]--
+	}
+	pod_status[ev.Name] = ev.Phase
+	status_counter[ev.Phase]++
+	ChangeStatus(ex, ev.Name, ostatus, ev.Phase)
+	if ev.Phase == "Succeeded" || ev.Phase == "Failed" {
+		// ChangeStatus just deleted the pod from the cluster, so unlike
+		// KuPoll (which rebuilds pod_status/status_counter from scratch
+		// every tick) we have to drop it ourselves here, or it would sit
+		// in status_counter[ev.Phase] forever since no further watch
+		// event will ever mention it again.
+		evictPod(ev.Name)
+	}
+	watchCond.Broadcast()
+}
+
+// evictPod removes podname from pod_status/status_counter. Caller must
+// already hold watchCond.L.
+func evictPod(podname string) {
+	if status, ok := pod_status[podname]; ok {
+		status_counter[status]--
+		delete(pod_status, podname)
+	}
+}
+
+// EvictPod removes podname from pod_status/status_counter and wakes any
+// goroutine blocked in WaitUntil, acquiring watchCond.L itself. Use this
+// for a pod that's deleted without ever reaching a terminal phase the
+// watch stream would observe (e.g. StageArtifacts' staging pod), so it
+// doesn't sit in status_counter forever.
+func EvictPod(podname string) {
+	watchCond.L.Lock()
+	defer watchCond.L.Unlock()
+	evictPod(podname)
+	watchCond.Broadcast()
+}
+
+// StartWatch launches a background goroutine that keeps pod_status and
+// status_counter up to date from ex.Watch(), reconnecting with backoff
+// opts.Poll if the stream ends. It returns an error immediately if the
+// backend can't open a watch at all, so callers can fall back to polling.
+func StartWatch(ex Executor) error {
+	events, err := ex.Watch()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			for ev := range events {
+				ApplyEvent(ex, ev)
+			}
+			debuglog.Println("watch stream ended, reconnecting")
+			Sleep(opts.Poll)
+			events, err = ex.Watch()
+			if err != nil {
+				errlog.Println("watch reconnect failed:", err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// WaitUntil blocks until cond() is true, re-checking it on every pod event
+// instead of sleeping and repolling.
+func WaitUntil(cond func() bool) {
+	watchCond.L.Lock()
+	defer watchCond.L.Unlock()
+	for !cond() {
+		watchCond.Wait()
+	}
+}